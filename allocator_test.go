@@ -0,0 +1,136 @@
+package hsup
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func newTestAllocator(
+	t *testing.T,
+	family AddressFamily,
+	privateSubnet net.IPNet,
+	dynoPrefixLen, minUID, maxUID int,
+) *Allocator {
+	workDir, err := ioutil.TempDir("", "hsup-allocator-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAllocator(workDir, family, privateSubnet, dynoPrefixLen, minUID, maxUID)
+	if err != nil {
+		os.RemoveAll(workDir)
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestPrivateNetForUIDv4(t *testing.T) {
+	a := newTestAllocator(t, AddressFamilyIPv4, DefaultPrivateSubnet, 30, 1000, 2000)
+
+	subnet, err := a.privateNetForUID(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subnet.IP.String(), "172.16.0.28"; got != want {
+		t.Errorf("privateNetForUID(1000) = %v, want %v", got, want)
+	}
+	if ones, _ := subnet.Mask.Size(); ones != 30 {
+		t.Errorf("mask = /%d, want /30", ones)
+	}
+
+	next, err := a.privateNetForUID(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := next.IP.String(), "172.16.0.32"; got != want {
+		t.Errorf("privateNetForUID(1001) = %v, want %v", got, want)
+	}
+}
+
+func TestPrivateNetForUIDv6(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestAllocator(t, AddressFamilyIPv6, *subnet, 126, 0, 10)
+
+	got, err := a.privateNetForUID(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ones, bits := got.Mask.Size(); ones != 126 || bits != 128 {
+		t.Errorf("mask = /%d (%d bits), want /126 (128 bits)", ones, bits)
+	}
+	if !subnet.Contains(got.IP) {
+		t.Errorf("privateNetForUID(0) = %v, not inside %v", got.IP, subnet)
+	}
+
+	next, err := a.privateNetForUID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IP.Equal(next.IP) {
+		t.Errorf("privateNetForUID(0) and (1) returned the same address %v", got.IP)
+	}
+}
+
+// TestPrivateNetForUIDWrapAround exercises the case where uid-minUID reaches
+// availableSubnets: allocation must wrap back around to the start of the
+// block instead of drifting outside privateSubnet.
+func TestPrivateNetForUIDWrapAround(t *testing.T) {
+	privateSubnet := net.IPNet{
+		IP:   net.IPv4(172, 16, 0, 0).To4(),
+		Mask: net.CIDRMask(24, 32),
+	}
+	// /24 with a /30 dynoPrefixLen provides 2**(30-24) = 64 subnets.
+	a := newTestAllocator(t, AddressFamilyIPv4, privateSubnet, 30, 0, 1000)
+
+	first, err := a.privateNetForUID(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := a.privateNetForUID(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.IP.Equal(wrapped.IP) {
+		t.Errorf("allocation did not wrap around: uid 0 = %v, uid 64 = %v",
+			first.IP, wrapped.IP)
+	}
+	if !privateSubnet.Contains(wrapped.IP) {
+		t.Errorf("wrapped address %v falls outside %v", wrapped.IP, privateSubnet)
+	}
+}
+
+// TestPrivateNetForUIDUnalignedBase covers a base IP that isn't aligned to
+// the start of its private subnet, so the blocks below it fall inside the
+// skip region computed by subnetsToSkip.
+func TestPrivateNetForUIDUnalignedBase(t *testing.T) {
+	// 172.16.0.28/12: base IP is offset 7 /30 blocks into the /12, which
+	// must be skipped so the first allocation starts at 172.16.0.28.
+	a := newTestAllocator(t, AddressFamilyIPv4, DefaultPrivateSubnet, 30, 0, 10)
+
+	subnet, err := a.privateNetForUID(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := subnet.IP.String(), "172.16.0.28"; got != want {
+		t.Errorf("privateNetForUID(0) = %v, want %v (skip region not honored)",
+			got, want)
+	}
+}
+
+func TestAllocatorRejectsMismatchedFamily(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "hsup-allocator-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if _, err := NewAllocator(workDir, AddressFamilyIPv6, DefaultPrivateSubnet, 126, 0, 10); err == nil {
+		t.Error("expected an error allocating an IPv6 family from an IPv4 subnet")
+	}
+}
@@ -3,6 +3,24 @@ package hsup
 import (
 	"log"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// debounceWindow coalesces bursts of filesystem events into a single
+	// check, since editors and release tooling commonly write-then-rename
+	// several files in quick succession.
+	debounceWindow = 250 * time.Millisecond
+
+	// safetyNetInterval is how often DirPoller re-checks the release
+	// directory even while fsnotify is working, as a safety net for
+	// filesystems where inotify is unreliable (NFS, some FUSE mounts).
+	safetyNetInterval = 30 * time.Second
+
+	// fallbackPollInterval is used when the fsnotify watcher can't be
+	// started or stops working entirely.
+	fallbackPollInterval = 10 * time.Second
 )
 
 type DirPoller struct {
@@ -21,32 +39,98 @@ func newControlDir() interface{} {
 func (dp *DirPoller) Notify() <-chan *Processes {
 	out := make(chan *Processes)
 	dp.c = newConf(newControlDir, dp.Dir)
-	go dp.pollSynchronous(out)
+	go dp.watch(out)
 	return out
 }
 
-func (dp *DirPoller) pollSynchronous(out chan<- *Processes) {
-	for {
-		var hs Startup
+// watch subscribes to filesystem events on dp.Dir and re-checks the release
+// snapshot whenever one arrives, instead of sleeping and polling. A slow
+// ticker still runs alongside the watcher as a safety net, and watch falls
+// back to plain polling entirely if fsnotify can't be used.
+func (dp *DirPoller) watch(out chan<- *Processes) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("could not start fsnotify watcher, falling back to polling:", err)
+		dp.pollSynchronous(out)
+		return
+	}
+	defer watcher.Close()
 
-		newInfo, err := dp.c.Notify()
-		if err != nil {
-			log.Println("Could not fetch new release information:",
-				err)
-			goto wait
-		}
+	if err := watcher.Add(dp.Dir); err != nil {
+		log.Println("could not watch", dp.Dir, ", falling back to polling:", err)
+		dp.pollSynchronous(out)
+		return
+	}
 
-		if !newInfo {
-			goto wait
-		}
+	ticker := time.NewTicker(safetyNetInterval)
+	defer ticker.Stop()
 
-		hs = Startup{
-			App:     *dp.c.Snapshot().(*AppSerializable),
-			Driver:  dp.Hs.Driver,
-			OneShot: dp.Hs.OneShot,
+	// debounceFired carries the debounce timer's expiry back onto this
+	// goroutine, so dp.check is only ever called from the select loop below
+	// instead of racing with it from the timer's own goroutine.
+	debounceFired := make(chan struct{}, 1)
+	var debounce *time.Timer
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				log.Println("fsnotify watcher closed, falling back to polling")
+				dp.pollSynchronous(out)
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			if debounce == nil {
+				debounce = time.AfterFunc(debounceWindow, func() {
+					select {
+					case debounceFired <- struct{}{}:
+					default:
+					}
+				})
+			} else {
+				debounce.Reset(debounceWindow)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				log.Println("fsnotify watcher closed, falling back to polling")
+				dp.pollSynchronous(out)
+				return
+			}
+			log.Println("fsnotify watcher error:", err)
+		case <-debounceFired:
+			dp.check(out)
+		case <-ticker.C:
+			dp.check(out)
 		}
-		out <- hs.Procs()
-	wait:
-		time.Sleep(10 * time.Second)
 	}
 }
+
+// pollSynchronous is the fallback used when fsnotify isn't available: check
+// for a new release every fallbackPollInterval.
+func (dp *DirPoller) pollSynchronous(out chan<- *Processes) {
+	for {
+		dp.check(out)
+		time.Sleep(fallbackPollInterval)
+	}
+}
+
+// check fetches the latest release snapshot and, if it's new, emits the
+// resulting Processes on out.
+func (dp *DirPoller) check(out chan<- *Processes) {
+	newInfo, err := dp.c.Notify()
+	if err != nil {
+		log.Println("Could not fetch new release information:", err)
+		return
+	}
+	if !newInfo {
+		return
+	}
+
+	hs := Startup{
+		App:     *dp.c.Snapshot().(*AppSerializable),
+		Driver:  dp.Hs.Driver,
+		OneShot: dp.Hs.OneShot,
+	}
+	out <- hs.Procs()
+}
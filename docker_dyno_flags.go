@@ -0,0 +1,339 @@
+package hsup
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// parseProcessFlag splits a flag value in "key=value" or
+// "process:key=value" form, the convention --resource-limits,
+// --security-profile and --stop-policy all share for scoping a setting to
+// one process type. process is "" for the bare form.
+func parseProcessFlag(s string) (process, key, value string, err error) {
+	kv := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		if j := strings.Index(s, "="); j < 0 || i < j {
+			process, kv = s[:i], s[i+1:]
+		}
+	}
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return "", "", "", fmt.Errorf("invalid value %q, want key=value", s)
+	}
+	return process, parts[0], parts[1], nil
+}
+
+// parseBytes parses a byte quantity with an optional k/m/g suffix (e.g.
+// "512m", "1g"), the same units docker itself accepts for --memory.
+func parseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty value")
+	}
+
+	mult := int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		mult, s = 1<<10, s[:len(s)-1]
+	case 'm', 'M':
+		mult, s = 1<<20, s[:len(s)-1]
+	case 'g', 'G':
+		mult, s = 1<<30, s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// AddResourceLimitFlags registers --resource-limits on fs, accumulating
+// repeated occurrences into limits (the driver-wide default) and overrides
+// (keyed by process type). A bare "key=value" (e.g. "memory=512m") sets
+// limits; a "process:key=value" form (e.g. "worker:memory=1g") sets
+// overrides[process]. Recognized keys: memory, memory-swap, cpu-shares,
+// cpu-quota, cpu-period, pids-limit, blkio-weight, and the repeatable
+// ulimit=name:soft:hard.
+func AddResourceLimitFlags(fs *flag.FlagSet, limits *ResourceLimits, overrides map[string]ResourceLimits) {
+	fs.Var(&resourceLimitsFlag{limits: limits, overrides: overrides}, "resource-limits",
+		`container resource limit, "key=value" or "process:key=value" (repeatable); `+
+			`keys: memory, memory-swap, cpu-shares, cpu-quota, cpu-period, `+
+			`pids-limit, blkio-weight, ulimit=name:soft:hard`)
+}
+
+type resourceLimitsFlag struct {
+	limits    *ResourceLimits
+	overrides map[string]ResourceLimits
+}
+
+func (f *resourceLimitsFlag) String() string { return "" }
+
+func (f *resourceLimitsFlag) Set(s string) error {
+	process, key, value, err := parseProcessFlag(s)
+	if err != nil {
+		return err
+	}
+	if process == "" {
+		return applyResourceLimit(f.limits, key, value)
+	}
+
+	rl := f.overrides[process]
+	if err := applyResourceLimit(&rl, key, value); err != nil {
+		return err
+	}
+	f.overrides[process] = rl
+	return nil
+}
+
+func applyResourceLimit(rl *ResourceLimits, key, value string) error {
+	switch key {
+	case "memory":
+		n, err := parseBytes(value)
+		if err != nil {
+			return fmt.Errorf("memory: %v", err)
+		}
+		rl.MemoryBytes = n
+	case "memory-swap":
+		n, err := parseBytes(value)
+		if err != nil {
+			return fmt.Errorf("memory-swap: %v", err)
+		}
+		rl.MemorySwapBytes = n
+	case "cpu-shares":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cpu-shares: %v", err)
+		}
+		rl.CPUShares = n
+	case "cpu-quota":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cpu-quota: %v", err)
+		}
+		rl.CPUQuotaUS = n
+	case "cpu-period":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("cpu-period: %v", err)
+		}
+		rl.CPUPeriodUS = n
+	case "pids-limit":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("pids-limit: %v", err)
+		}
+		rl.PidsLimit = n
+	case "blkio-weight":
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("blkio-weight: %v", err)
+		}
+		rl.BlkioWeight = uint16(n)
+	case "ulimit":
+		u, err := parseUlimit(value)
+		if err != nil {
+			return err
+		}
+		rl.Ulimits = append(rl.Ulimits, u)
+	default:
+		return fmt.Errorf("unknown resource limit %q", key)
+	}
+	return nil
+}
+
+func parseUlimit(value string) (docker.ULimit, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return docker.ULimit{}, fmt.Errorf("ulimit: want name:soft:hard, got %q", value)
+	}
+	soft, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return docker.ULimit{}, fmt.Errorf("ulimit: %v", err)
+	}
+	hard, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return docker.ULimit{}, fmt.Errorf("ulimit: %v", err)
+	}
+	return docker.ULimit{Name: parts[0], Soft: soft, Hard: hard}, nil
+}
+
+// AddSecurityProfileFlags registers --security-profile on fs, accumulating
+// repeated occurrences into profile (the driver-wide default) and overrides
+// (keyed by process type), the same "key=value"/"process:key=value"
+// convention as AddResourceLimitFlags. Recognized keys: cap-drop
+// (repeatable), no-new-privileges, read-only-rootfs, tmpfs=path[:opts]
+// (repeatable), seccomp=path, apparmor=profile.
+func AddSecurityProfileFlags(fs *flag.FlagSet, profile *SecurityProfile, overrides map[string]SecurityProfile) {
+	fs.Var(&securityProfileFlag{profile: profile, overrides: overrides}, "security-profile",
+		`container security option, "key=value" or "process:key=value" (repeatable); `+
+			`keys: cap-drop, no-new-privileges, read-only-rootfs, tmpfs=path[:opts], `+
+			`seccomp=path, apparmor=profile`)
+}
+
+type securityProfileFlag struct {
+	profile   *SecurityProfile
+	overrides map[string]SecurityProfile
+}
+
+func (f *securityProfileFlag) String() string { return "" }
+
+func (f *securityProfileFlag) Set(s string) error {
+	process, key, value, err := parseProcessFlag(s)
+	if err != nil {
+		return err
+	}
+	if process == "" {
+		return applySecurityProfile(f.profile, key, value)
+	}
+
+	sp := f.overrides[process]
+	if err := applySecurityProfile(&sp, key, value); err != nil {
+		return err
+	}
+	f.overrides[process] = sp
+	return nil
+}
+
+func applySecurityProfile(sp *SecurityProfile, key, value string) error {
+	switch key {
+	case "cap-drop":
+		sp.CapDrop = append(sp.CapDrop, value)
+	case "no-new-privileges":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("no-new-privileges: %v", err)
+		}
+		sp.NoNewPrivileges = b
+	case "read-only-rootfs":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("read-only-rootfs: %v", err)
+		}
+		sp.ReadonlyRootfs = b
+	case "tmpfs":
+		path, opts := value, ""
+		if i := strings.Index(value, ":"); i >= 0 {
+			path, opts = value[:i], value[i+1:]
+		}
+		if sp.Tmpfs == nil {
+			sp.Tmpfs = map[string]string{}
+		}
+		sp.Tmpfs[path] = opts
+	case "seccomp":
+		sp.SeccompProfilePath = value
+	case "apparmor":
+		sp.AppArmorProfile = value
+	default:
+		return fmt.Errorf("unknown security profile option %q", key)
+	}
+	return nil
+}
+
+// signalsByName maps the names hsup's --signal/--stop-policy flags accept
+// (with or without the "SIG" prefix, e.g. "TERM" or "SIGTERM") to the
+// syscall.Signal to send.
+var signalsByName = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+func parseSignalName(s string) (os.Signal, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	sig, ok := signalsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal %q", s)
+	}
+	return sig, nil
+}
+
+// AddStopFlags registers hsup's "stop" subcommand flags on fs: --timeout
+// and --signal set policy, the driver-wide StopPolicy, directly; the
+// repeatable --stop-policy (e.g. "worker:timeout=30s") sets overrides,
+// keyed by process type, the same convention AddResourceLimitFlags and
+// AddSecurityProfileFlags use. Recognized --stop-policy keys: timeout,
+// signal, escalation-signal.
+func AddStopFlags(fs *flag.FlagSet, policy *StopPolicy, overrides map[string]StopPolicy) {
+	fs.DurationVar(&policy.Grace, "timeout", DefaultStopPolicy.Grace,
+		"how long to wait after --signal before escalating to SIGKILL")
+	fs.Var(&signalFlag{sig: &policy.Signal}, "signal",
+		"signal to send first, e.g. TERM, INT, HUP")
+	fs.Var(&stopPolicyFlag{overrides: overrides}, "stop-policy",
+		`per-process-type stop policy override, "process:key=value" `+
+			`(repeatable); keys: timeout, signal, escalation-signal`)
+}
+
+type signalFlag struct {
+	sig *os.Signal
+}
+
+func (f *signalFlag) String() string {
+	if f.sig == nil || *f.sig == nil {
+		return ""
+	}
+	return (*f.sig).String()
+}
+
+func (f *signalFlag) Set(s string) error {
+	sig, err := parseSignalName(s)
+	if err != nil {
+		return err
+	}
+	*f.sig = sig
+	return nil
+}
+
+type stopPolicyFlag struct {
+	overrides map[string]StopPolicy
+}
+
+func (f *stopPolicyFlag) String() string { return "" }
+
+func (f *stopPolicyFlag) Set(s string) error {
+	process, key, value, err := parseProcessFlag(s)
+	if err != nil {
+		return err
+	}
+	if process == "" {
+		return fmt.Errorf(
+			"--stop-policy requires a process type prefix, e.g. worker:%s", s)
+	}
+
+	policy := f.overrides[process]
+	switch key {
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("timeout: %v", err)
+		}
+		policy.Grace = d
+	case "signal":
+		sig, err := parseSignalName(value)
+		if err != nil {
+			return err
+		}
+		policy.Signal = sig
+	case "escalation-signal":
+		sig, err := parseSignalName(value)
+		if err != nil {
+			return err
+		}
+		policy.EscalationSignal = sig
+	default:
+		return fmt.Errorf("unknown stop policy option %q", key)
+	}
+	f.overrides[process] = policy
+	return nil
+}